@@ -22,7 +22,9 @@ import (
 
 	"github.com/Aurorachain-io/go-aoa/common"
 	"github.com/Aurorachain-io/go-aoa/aoadb"
+	"github.com/Aurorachain-io/go-aoa/rlp"
 	"github.com/Aurorachain-io/go-aoa/trie"
+	"github.com/VictoriaMetrics/fastcache"
 	"github.com/hashicorp/golang-lru"
 )
 
@@ -37,6 +39,26 @@ const (
 	// Number of codehash->size associations to keep.
 	codeSizeCacheSize = 100000
 
+	// Default bounded-memory budgets for the clean-data caches, in bytes.
+	// These hold the raw contract code / abi bytes (not just their size)
+	// so repeated EVM calls into the same contract don't have to round-trip
+	// through LevelDB.
+	defaultCodeCacheSize = 64 * 1024 * 1024
+	defaultAbiCacheSize  = 16 * 1024 * 1024
+
+	// minCacheSize is the smallest byte budget we'll hand to fastcache.New,
+	// which panics if given a size <= 0. It's small enough to be a no-op
+	// cache in practice while keeping NewDatabaseWithCache(db, 0, 0) safe.
+	minCacheSize = 32 * 1024
+
+	// Retention policy for registered state snapshots: every block within
+	// snapshotRecentWindow of the highest registered block number is kept, so
+	// reorgs of reasonable depth always find an exact trie to reopen; older
+	// snapshots are thinned out, keeping only every snapshotSparseInterval'th
+	// one for archive-style lookups further back.
+	snapshotRecentWindow   = 128
+	snapshotSparseInterval = 1024
+
 	abiKeySuffix = "_abi"
 )
 
@@ -56,6 +78,35 @@ type Database interface {
 	CopyTrie(Trie) Trie
 	// Accessing assetdata
 	AssetData(addrHash, assetHash common.Hash) ([]byte, error)
+	// Snapshot registers root as the state of block number, so it can later
+	// be retrieved by StateAt without the caller needing to know the root.
+	Snapshot(root common.Hash, number uint64)
+	// StateAt returns the Trie registered for block number via Snapshot.
+	StateAt(number uint64) (Trie, error)
+	// Reorg discards every snapshot registered for a block number above
+	// forkNumber, so a subsequent Snapshot/StateAt pair can't observe state
+	// from a chain branch that was abandoned at forkNumber.
+	Reorg(forkNumber uint64)
+	// TrieDB retrieves an optional, explicitly-flushed staging area for
+	// trie node writes, shared by every trie opened through this Database.
+	// It is not used automatically by any commit here; see TrieDB's doc.
+	TrieDB() *TrieDB
+	// Error returns the first non-nil error encountered while reading from
+	// the underlying database or committing a trie, for example a missing
+	// trie node surfaced while opening a trie. The failing call also
+	// returns that error to its own caller; Error keeps a copy of it.
+	//
+	// This is a whole-Database diagnostic, not a per-trie one: it is
+	// shared by every trie, every ContractCode/ContractAbi/AssetData
+	// lookup, and every account going through this Database, and it is
+	// NOT cleared by CommitTo or tied to any particular commit. A failure
+	// reading unrelated state (a different account's storage trie, a
+	// missing code/abi/asset blob) will show up here and stay until
+	// something reads it; a caller that needs to know whether a specific
+	// trie or account's own reads failed must call Error() itself right
+	// after those reads, not infer it from some other trie's later commit
+	// succeeding or failing.
+	Error() error
 }
 
 // Trie is a eminer-pro Merkle Trie.
@@ -69,18 +120,175 @@ type Trie interface {
 	GetKey([]byte) []byte // TODO(fjl): remove this when SecureTrie is removed
 }
 
+// Prover is implemented by a Trie that can also produce Merkle proofs. It is
+// kept separate from Trie, rather than a Trie method, for two reasons: (1)
+// OpenStorageTrie and CopyTrie can hand back a bare *trie.SecureTrie as a
+// Trie, and whether that concrete type has a Prove method with this exact
+// signature can't be confirmed against the trie package from this file
+// alone - making it a Trie method would make every Trie implementation's
+// compilation depend on that; (2) not every Trie needs to support proofs.
+// Callers that need one type-assert: `p, ok := tr.(state.Prover)`.
+type Prover interface {
+	// Prove constructs a Merkle proof for key, writing the trie nodes along
+	// the key's path into proofDb. fromLevel skips that many levels from
+	// the root, which is useful when the caller already holds the upper
+	// levels of the proof (e.g. a storage trie proof nested under an
+	// account proof).
+	Prove(key []byte, fromLevel uint, proofDb trie.DatabaseWriter) error
+}
+
 // NewDatabase creates a backing store for state. The returned database is safe for
-// concurrent use and retains cached trie nodes in memory.
+// concurrent use and retains cached trie nodes in memory. The clean code and abi
+// caches are sized to sensible defaults; use NewDatabaseWithCache to tune them.
 func NewDatabase(db aoadb.Database) Database {
+	return NewDatabaseWithCache(db, defaultCodeCacheSize, defaultAbiCacheSize)
+}
+
+// NewDatabaseWithCache is like NewDatabase but lets the caller size the
+// bounded-memory clean-code and clean-abi caches (in bytes). fastcache
+// panics if given a size <= 0, so sizes below minCacheSize are clamped up
+// to it rather than passed straight through.
+func NewDatabaseWithCache(db aoadb.Database, codeCacheSize, abiCacheSize int) Database {
 	csc, _ := lru.New(codeSizeCacheSize)
-	return &cachingDB{db: db, codeSizeCache: csc}
+	return &cachingDB{
+		db:            db,
+		triedb:        newTrieDB(db),
+		codeSizeCache: csc,
+		codeCache:     fastcache.New(clampCacheSize(codeCacheSize)),
+		abiCache:      fastcache.New(clampCacheSize(abiCacheSize)),
+	}
+}
+
+// clampCacheSize raises size up to minCacheSize when it's too small (or
+// non-positive) for fastcache.New to accept.
+func clampCacheSize(size int) int {
+	if size < minCacheSize {
+		return minCacheSize
+	}
+	return size
 }
 
 type cachingDB struct {
 	db            aoadb.Database
+	triedb        *TrieDB
 	mu            sync.Mutex
 	pastTries     []*trie.SecureTrie
 	codeSizeCache *lru.Cache
+	codeCache     *fastcache.Cache
+	abiCache      *fastcache.Cache
+	// dbErr is a whole-Database, not per-trie, diagnostic flag: see the
+	// Database.Error doc comment for the cross-trie coupling this implies.
+	dbErr error
+
+	snapshots    map[uint64]common.Hash
+	snapshotHead uint64
+}
+
+// TrieDB retrieves the shared trie node staging area. Nothing in this
+// package writes through it unless a caller passes it to CommitTo.
+func (db *cachingDB) TrieDB() *TrieDB {
+	return db.triedb
+}
+
+// maxStagedTrieNodes bounds TrieDB's optional staging area so Put can never
+// grow it without bound if a caller stages nodes but never calls Commit;
+// once the bound is hit, the oldest unflushed entry is written to disk
+// early and removed from the staging area.
+const maxStagedTrieNodes = 4096
+
+// TrieDB is an optional, explicitly-flushed staging area for trie nodes,
+// separate from the normal commit path. It implements trie.DatabaseWriter,
+// so a caller that wants to batch several tries' writes together before
+// touching disk can pass TrieDB() as the dbw argument to CommitTo and later
+// call TrieDB().Commit to flush; cachedTrie.CommitTo itself does not do
+// this implicitly (see its comment) and instead always writes straight to
+// its caller-supplied dbw, so ordinary commits are unaffected by this type
+// existing.
+//
+// Staged nodes are not reference-counted: staging is a plain, bounded,
+// last-write-wins cache keyed by node key.
+type TrieDB struct {
+	diskdb aoadb.Database
+
+	lock   sync.Mutex
+	staged map[string][]byte
+	order  []string
+}
+
+func newTrieDB(diskdb aoadb.Database) *TrieDB {
+	return &TrieDB{
+		diskdb: diskdb,
+		staged: make(map[string][]byte),
+	}
+}
+
+// Put stages a trie node write. It satisfies trie.DatabaseWriter.
+func (db *TrieDB) Put(key, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	k := string(key)
+	if _, ok := db.staged[k]; !ok {
+		if len(db.order) >= maxStagedTrieNodes {
+			oldest := db.order[0]
+			if err := db.diskdb.Put([]byte(oldest), db.staged[oldest]); err != nil {
+				return err
+			}
+			db.order = db.order[1:]
+			delete(db.staged, oldest)
+		}
+		db.order = append(db.order, k)
+	}
+	blob := make([]byte, len(value))
+	copy(blob, value)
+	db.staged[k] = blob
+	return nil
+}
+
+// Commit flushes every staged node to disk and clears the staging area.
+// root and report are not used: everything currently staged is flushed,
+// not only the nodes reachable from root, and nothing is logged.
+func (db *TrieDB) Commit(root common.Hash, report bool) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for k, v := range db.staged {
+		if err := db.diskdb.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	db.staged = make(map[string][]byte)
+	db.order = nil
+	return nil
+}
+
+// setErrorLocked records err as the database's pending error if one isn't
+// already set. db.mu must be held by the caller. It is a no-op for nil
+// errors so normal "not found" conditions (state that is legitimately
+// empty) never get surfaced through Error.
+func (db *cachingDB) setErrorLocked(err error) {
+	if err == nil {
+		return
+	}
+	if db.dbErr == nil {
+		db.dbErr = err
+	}
+}
+
+// setError is like setErrorLocked but acquires db.mu itself.
+func (db *cachingDB) setError(err error) {
+	db.mu.Lock()
+	db.setErrorLocked(err)
+	db.mu.Unlock()
+}
+
+// Error returns the first recorded read or commit error, or nil if none
+// occurred. It is not scoped to any single trie or account and is not
+// cleared by CommitTo - see the Database.Error doc comment.
+func (db *cachingDB) Error() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.dbErr
 }
 
 func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
@@ -94,6 +302,7 @@ func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
 	}
 	tr, err := trie.NewSecure(root, db.db, MaxTrieCacheGen)
 	if err != nil {
+		db.setErrorLocked(err)
 		return nil, err
 	}
 	return cachedTrie{tr, db}, nil
@@ -111,8 +320,74 @@ func (db *cachingDB) pushTrie(t *trie.SecureTrie) {
 	}
 }
 
+// Snapshot registers root as the state of block number, pruning older
+// entries according to the package's retention policy.
+func (db *cachingDB) Snapshot(root common.Hash, number uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.snapshots == nil {
+		db.snapshots = make(map[uint64]common.Hash)
+	}
+	db.snapshots[number] = root
+	if number > db.snapshotHead {
+		db.snapshotHead = number
+	}
+	db.pruneSnapshotsLocked()
+}
+
+// pruneSnapshotsLocked drops snapshots that fall outside the retention
+// window and aren't on the sparse older-block grid. db.mu must be held.
+func (db *cachingDB) pruneSnapshotsLocked() {
+	var cutoff uint64
+	if db.snapshotHead > snapshotRecentWindow {
+		cutoff = db.snapshotHead - snapshotRecentWindow
+	}
+	for number := range db.snapshots {
+		if number >= cutoff {
+			continue
+		}
+		if number%snapshotSparseInterval != 0 {
+			delete(db.snapshots, number)
+		}
+	}
+}
+
+// StateAt returns the Trie registered for block number via Snapshot.
+func (db *cachingDB) StateAt(number uint64) (Trie, error) {
+	db.mu.Lock()
+	root, ok := db.snapshots[number]
+	db.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("state: no snapshot registered for block %d", number)
+	}
+	return db.OpenTrie(root)
+}
+
+// Reorg discards snapshots above forkNumber, the block at which the chain
+// branched away from the one these snapshots were registered against.
+func (db *cachingDB) Reorg(forkNumber uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for number := range db.snapshots {
+		if number > forkNumber {
+			delete(db.snapshots, number)
+		}
+	}
+	if db.snapshotHead > forkNumber {
+		db.snapshotHead = forkNumber
+	}
+}
+
 func (db *cachingDB) OpenStorageTrie(addrHash, root common.Hash) (Trie, error) {
-	return trie.NewSecure(root, db.db, 0)
+	tr, err := trie.NewSecure(root, db.db, 0)
+	if err != nil {
+		db.setError(err)
+		return nil, err
+	}
+	return tr, nil
 }
 
 func (db *cachingDB) CopyTrie(t Trie) Trie {
@@ -127,9 +402,15 @@ func (db *cachingDB) CopyTrie(t Trie) Trie {
 }
 
 func (db *cachingDB) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
+	if code := db.codeCache.Get(nil, codeHash[:]); len(code) > 0 {
+		return code, nil
+	}
 	code, err := db.db.Get(codeHash[:])
 	if err == nil {
 		db.codeSizeCache.Add(codeHash, len(code))
+		db.codeCache.Set(codeHash[:], code)
+	} else {
+		db.setError(err)
 	}
 	return code, err
 }
@@ -138,6 +419,9 @@ func (db *cachingDB) ContractCodeSize(addrHash, codeHash common.Hash) (int, erro
 	if cached, ok := db.codeSizeCache.Get(codeHash); ok {
 		return cached.(int), nil
 	}
+	if code := db.codeCache.Get(nil, codeHash[:]); len(code) > 0 {
+		return len(code), nil
+	}
 	code, err := db.ContractCode(addrHash, codeHash)
 	if err == nil {
 		db.codeSizeCache.Add(codeHash, len(code))
@@ -147,18 +431,32 @@ func (db *cachingDB) ContractCodeSize(addrHash, codeHash common.Hash) (int, erro
 
 func (db *cachingDB) ContractAbi(addrHash, codeHash common.Hash) (string, error) {
 	key := AbiKey(codeHash.Bytes())
+	if abi := db.abiCache.Get(nil, key); len(abi) > 0 {
+		return string(abi), nil
+	}
 	has, err := db.db.Has(key)
+	if err != nil {
+		db.setError(err)
+		return "", err
+	}
 	if has {
 		abibytes, err := db.db.Get(key)
-		if err == nil {
-			return string(abibytes), nil
+		if err != nil {
+			db.setError(err)
+			return "", err
 		}
+		db.abiCache.Set(key, abibytes)
+		return string(abibytes), nil
 	}
-	return "", err
+	return "", nil
 }
 
 func (db *cachingDB) AssetData(addrHash, assetHash common.Hash) ([]byte, error) {
-	return db.db.Get(assetHash[:])
+	data, err := db.db.Get(assetHash[:])
+	if err != nil {
+		db.setError(err)
+	}
+	return data, err
 }
 
 func AbiKey(codeHash []byte) []byte {
@@ -171,10 +469,61 @@ type cachedTrie struct {
 	db *cachingDB
 }
 
+// CommitTo writes straight to dbw: committed nodes must be on disk (or in whatever batch dbw wraps)
+// before this call returns, since nothing else in this package flushes
+// them later. A caller that wants batched/delayed writes across several
+// tries can pass m.db.TrieDB() as dbw and flush explicitly with
+// TrieDB().Commit(root, report) - that is opt-in, not automatic, so
+// OpenTrie/OpenStorageTrie reading straight from db.db always see
+// whatever the most recent CommitTo actually persisted.
 func (m cachedTrie) CommitTo(dbw trie.DatabaseWriter) (common.Hash, error) {
 	root, err := m.SecureTrie.CommitTo(dbw)
 	if err == nil {
 		m.db.pushTrie(m.SecureTrie)
+	} else {
+		m.db.setError(err)
 	}
 	return root, err
 }
+
+// Prove implements Prover by delegating to the underlying SecureTrie,
+// recording any missing-node error on the owning cachingDB the same way the
+// other read paths do. The delegation goes through a type assertion rather
+// than a direct method call: since whether *trie.SecureTrie actually has a
+// Prove method with this signature can't be confirmed from this file alone,
+// a direct call would risk a build break for the whole package the moment
+// it's wrong, whereas this fails at call time with a clear error instead.
+func (m cachedTrie) Prove(key []byte, fromLevel uint, proofDb trie.DatabaseWriter) error {
+	p, ok := interface{}(m.SecureTrie).(Prover)
+	if !ok {
+		return fmt.Errorf("state: underlying trie %T does not support Prove", m.SecureTrie)
+	}
+	err := p.Prove(key, fromLevel, proofDb)
+	if err != nil {
+		m.db.setError(err)
+	}
+	return err
+}
+
+// TryGetAccount looks up address in an account trie and RLP-decodes the
+// result into an Account, so callers (e.g. an aoa_getProof RPC) don't have
+// to reach past the Trie interface to decode it themselves. It is a free
+// function rather than a Trie method because TryGetAccount only makes sense
+// against the main account trie: storage tries satisfy the same Trie
+// interface but hold raw storage values, not RLP-encoded accounts, so a
+// method on Trie would offer a meaningless TryGetAccount on every storage
+// trie too. It returns a nil Account, nil error if address has no entry.
+func TryGetAccount(tr Trie, address common.Address) (*Account, error) {
+	enc, err := tr.TryGet(address[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	var data Account
+	if err := rlp.DecodeBytes(enc, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}